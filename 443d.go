@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -12,11 +12,16 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/myfreeweb/443d/demux"
 	"github.com/myfreeweb/443d/keepalive"
 	"github.com/ryanuber/go-glob"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/http2"
 	"gopkg.in/yaml.v2"
 )
@@ -31,10 +36,26 @@ type Config struct {
 			Seconds    int
 			Subdomains bool
 		}
-		Hpkp struct {
-			Seconds    int
-			Subdomains bool
-			BackupKeys []string `yaml:"backup_keys"`
+		ExpectCt struct {
+			Seconds   int
+			Enforce   bool
+			ReportUri string `yaml:"report_uri"`
+		}
+		PermissionsPolicy string `yaml:"permissions_policy"`
+		PinLog            string `yaml:"pin_log"`
+		PinEnforce        bool   `yaml:"pin_enforce"`
+		Acme struct {
+			Enabled      bool
+			Email        string
+			CacheDir     string `yaml:"cache_dir"`
+			Staging      bool
+			DirectoryURL string `yaml:"directory_url"`
+			EabKeyID     string `yaml:"eab_key_id"`
+			EabHmacKey   string `yaml:"eab_hmac_key"`
+		}
+		Demux struct {
+			ProxyProtocol bool `yaml:"proxy_protocol"`
+			Matchers      []DemuxMatcher
 		}
 	}
 	Http struct {
@@ -45,20 +66,73 @@ type Config struct {
 	}
 	Hosts       []HttpBackend
 	DefaultHost string
+	Limits      Limits
+}
+
+// DemuxMatcher configures one additional protocol the TLS listener's
+// demultiplexer should recognize, besides the default SSH/TLS pair.
+type DemuxMatcher struct {
+	Protocol string
+	Backend  string
+}
+
+// serverState is an immutable snapshot of everything derived from the
+// configuration file: the parsed config itself plus whatever we compute
+// from it (the static keypair, the HSTS/Expect-CT header values, the ACME
+// manager, the SPKI pin store). A reload builds a brand new serverState
+// and swaps it in atomically, so in-flight requests never see a
+// half-updated config.
+type serverState struct {
+	config         Config
+	tlsKeyPair     tls.Certificate
+	hstsHeader     string
+	expectCtHeader string
+	acmeManager    *autocert.Manager
+	pinStore       *PinStore
+}
+
+// Server holds the single current serverState behind an atomic.Value, so
+// readers never block and a reload never races with a request handler.
+type Server struct {
+	state atomic.Value
+}
+
+func (s *Server) current() *serverState {
+	return s.state.Load().(*serverState)
+}
+
+func (s *Server) store(st *serverState) {
+	s.state.Store(st)
+}
+
+// reload re-reads the config file and, if it parses and validates cleanly,
+// swaps it in as the current state. On any error the old state (and thus
+// the old TLS keypair and Hosts) keeps serving.
+func (s *Server) reload() {
+	cfg, err := readConfig()
+	if err != nil {
+		log.Printf("Not reloading, config is broken: %v :-(\n", err)
+		return
+	}
+	st, err := buildState(cfg, s.current())
+	if err != nil {
+		log.Printf("Not reloading, config is broken: %v :-(\n", err)
+		return
+	}
+	s.store(st)
+	log.Printf("Reloaded the configuration\n")
 }
 
 var confpath = flag.String("config", "/usr/local/etc/443d.yaml", "path to the configuration file")
-var config Config
-var tlsKeyPair tls.Certificate
-var hstsHeader string
-var hpkpHeader string
+var srv = &Server{}
 
 var httpHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	st := srv.current()
 	if r.Host == "" {
-		r.Host = config.DefaultHost
+		r.Host = st.config.DefaultHost
 	}
-	for hostid := range config.Hosts {
-		hostcnf := config.Hosts[hostid]
+	for hostid := range st.config.Hosts {
+		hostcnf := st.config.Hosts[hostid]
 		for hostnid := range hostcnf.Hostnames {
 			hostn := hostcnf.Hostnames[hostnid]
 			if glob.Glob(hostn, r.Host) {
@@ -75,58 +149,117 @@ var redirHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	readConfig()
-	processConfig()
+	flag.Parse()
+	cfg, err := readConfig()
+	if err != nil {
+		log.Fatalf("%v :-(\n", err)
+	}
+	st, err := buildState(cfg, nil)
+	if err != nil {
+		log.Fatalf("%v :-(\n", err)
+	}
+	srv.store(st)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			srv.reload()
+		}
+	}()
+
 	errc := make(chan error, 1)
 	go func() {
-		addr := config.Redirector.Listen
+		addr := srv.current().config.Redirector.Listen
 		if addr == "" {
 			log.Printf("No listen address for the Redirector server \n")
 			return
 		}
-		srv := &http.Server{Addr: addr, Handler: redirHandler}
+		handler := redirHandler
+		if m := srv.current().acmeManager; m != nil {
+			handler = m.HTTPHandler(nil)
+		}
+		httpsrv := &http.Server{Addr: addr, Handler: handler}
+		srv.current().config.Limits.applyTimeouts(httpsrv)
 		tcpl := listen(addr)
 		kal := keepalive.KeepAliveListener{tcpl.(*net.TCPListener)}
-		errc <- serve("Redirector server", srv, kal)
+		throttled := newThrottledListener(kal, func() Limits { return srv.current().config.Limits })
+		errc <- serve("Redirector server", httpsrv, throttled)
 	}()
 	go func() {
-		addr := config.Http.Listen
+		addr := srv.current().config.Http.Listen
 		if addr == "" {
 			log.Printf("No listen address for the HTTP server \n")
 			return
 		}
-		srv := &http.Server{Addr: addr, Handler: httpHandler}
+		httpsrv := &http.Server{Addr: addr, Handler: httpHandler}
+		srv.current().config.Limits.applyTimeouts(httpsrv)
 		tcpl := listen(addr)
 		kal := keepalive.KeepAliveListener{tcpl.(*net.TCPListener)}
-		errc <- serve("HTTP server", srv, kal)
+		throttled := newThrottledListener(kal, func() Limits { return srv.current().config.Limits })
+		errc <- serve("HTTP server", httpsrv, throttled)
 	}()
 	go func() {
-		addr := config.Tls.Listen
+		addr := srv.current().config.Tls.Listen
 		if addr == "" {
 			log.Printf("No listen address for the TLS server \n")
 			return
 		}
-		if config.Tls.Cert == "" && config.Tls.Key == "" {
+		tlsCfg := srv.current().config.Tls
+		if tlsCfg.Cert == "" && tlsCfg.Key == "" && !tlsCfg.Acme.Enabled {
 			log.Printf("No keypair for the TLS server \n")
 			return
 		}
 		secHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if config.Tls.Hsts.Seconds != 0 {
-				w.Header().Add("Strict-Transport-Security", hstsHeader)
+			st := srv.current()
+			if st.config.Tls.Hsts.Seconds != 0 {
+				w.Header().Add("Strict-Transport-Security", st.hstsHeader)
 			}
-			if config.Tls.Hpkp.Seconds != 0 {
-				w.Header().Add("Public-Key-Pins", hpkpHeader)
+			if st.config.Tls.ExpectCt.Seconds != 0 {
+				w.Header().Add("Expect-CT", st.expectCtHeader)
+			}
+			if st.config.Tls.PermissionsPolicy != "" {
+				w.Header().Add("Permissions-Policy", st.config.Tls.PermissionsPolicy)
 			}
 			httpHandler.ServeHTTP(w, r)
 		})
-		srv := &http.Server{Addr: addr, Handler: secHandler}
-		http2.ConfigureServer(srv, &http2.Server{})
-		srv.TLSConfig.Certificates = []tls.Certificate{tlsKeyPair}
+		httpsrv := &http.Server{Addr: addr, Handler: secHandler}
+		srv.current().config.Limits.applyTimeouts(httpsrv)
+		http2.ConfigureServer(httpsrv, &http2.Server{})
+		httpsrv.TLSConfig.NextProtos = append(httpsrv.TLSConfig.NextProtos, acme.ALPNProto)
+		httpsrv.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			st := srv.current()
+			var cert *tls.Certificate
+			var err error
+			if st.acmeManager != nil {
+				cert, err = st.acmeManager.GetCertificate(hello)
+			} else {
+				cert = &st.tlsKeyPair
+			}
+			if err != nil {
+				return nil, err
+			}
+			if st.pinStore != nil && cert.Leaf != nil {
+				if err := st.pinStore.Observe(hello.ServerName, cert.Leaf); err != nil {
+					return nil, err
+				}
+			}
+			return cert, nil
+		}
 		tcpl := listen(addr)
-		sshh := demux.SshHandler(config.Tls.Ssh)
-		dl := demux.DemultiplexingListener{tcpl.(*net.TCPListener), sshh}
-		tlsl := tls.NewListener(dl, srv.TLSConfig)
-		errc <- serve("TLS server", srv, tlsl)
+		throttled := newThrottledListener(tcpl, func() Limits { return srv.current().config.Limits })
+		dl := buildDemuxListener(throttled)
+		tlsl := tls.NewListener(dl, httpsrv.TLSConfig)
+		errc <- serve("TLS server", httpsrv, tlsl)
+	}()
+	go func() {
+		addr := srv.current().config.Limits.Metrics
+		if addr == "" {
+			return
+		}
+		httpsrv := &http.Server{Addr: addr, Handler: metricsHandler}
+		tcpl := listen(addr)
+		errc <- serve("Metrics server", httpsrv, tcpl)
 	}()
 	log.Fatalf("error: %v :-(\n", <-errc)
 }
@@ -139,63 +272,177 @@ func listen(addr string) net.Listener {
 	return tcpl
 }
 
-func serve(name string, srv *http.Server, listener net.Listener) error {
-	log.Printf("Starting the "+name+" on tcp %v\n", srv.Addr)
-	return srv.Serve(listener)
+func serve(name string, httpsrv *http.Server, listener net.Listener) error {
+	log.Printf("Starting the "+name+" on tcp %v\n", httpsrv.Addr)
+	return httpsrv.Serve(listener)
 }
 
-func readConfig() {
-	flag.Parse()
+// buildDemuxListener wraps tcpl in a demux.DemultiplexingListener whose
+// matcher chain and ProxyProtocol flag are read from srv.current() on
+// every Accept, so a SIGHUP reload that changes Tls.Ssh or
+// Tls.Demux.Matchers takes effect on the next connection instead of only
+// at process start.
+func buildDemuxListener(tcpl net.Listener) *demux.DemultiplexingListener {
+	return &demux.DemultiplexingListener{
+		Listener:      tcpl,
+		ProxyProtocol: func() bool { return srv.current().config.Tls.Demux.ProxyProtocol },
+		Routes:        func() []demux.Route { return buildDemuxRoutes(srv.current()) },
+	}
+}
+
+// buildDemuxRoutes assembles the ordered matcher chain for the TLS
+// listener's port-443 demultiplexer: the SSH backend configured at
+// Tls.Ssh (kept for backwards compatibility), followed by whatever
+// additional protocols Tls.Demux.Matchers lists. Anything matching none
+// of them falls through to the default protocol, TLS.
+func buildDemuxRoutes(st *serverState) []demux.Route {
+	var routes []demux.Route
+	if st.config.Tls.Ssh != "" {
+		routes = append(routes, demux.Route{Match: demux.SshMatcher, Sink: demux.NewForwarder(st.config.Tls.Ssh)})
+	}
+	for _, m := range st.config.Tls.Demux.Matchers {
+		var match demux.Matcher
+		switch m.Protocol {
+		case "ssh":
+			match = demux.SshMatcher
+		case "http":
+			match = demux.HTTPMatcher
+		case "openvpn":
+			match = demux.OpenVPNMatcher
+		case "wireguard":
+			match = demux.WireGuardMatcher
+		default:
+			log.Printf("Unknown demux matcher protocol %q, ignoring\n", m.Protocol)
+			continue
+		}
+		routes = append(routes, demux.Route{Match: match, Sink: demux.NewForwarder(m.Backend)})
+	}
+	return routes
+}
+
+func buildAcmeManager(cfg *Config) (*autocert.Manager, error) {
+	patterns := make([]string, 0)
+	for hostid := range cfg.Hosts {
+		patterns = append(patterns, cfg.Hosts[hostid].Hostnames...)
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Email:      cfg.Tls.Acme.Email,
+		HostPolicy: globHostPolicy(patterns),
+	}
+	if cfg.Tls.Acme.CacheDir != "" {
+		m.Cache = autocert.DirCache(cfg.Tls.Acme.CacheDir)
+	}
+	client := &acme.Client{}
+	if cfg.Tls.Acme.Staging {
+		client.DirectoryURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	}
+	if cfg.Tls.Acme.DirectoryURL != "" {
+		client.DirectoryURL = cfg.Tls.Acme.DirectoryURL
+	}
+	if client.DirectoryURL != "" {
+		m.Client = client
+	}
+	if cfg.Tls.Acme.EabKeyID != "" && cfg.Tls.Acme.EabHmacKey != "" {
+		key, err := base64.RawURLEncoding.DecodeString(cfg.Tls.Acme.EabHmacKey)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding ACME EAB HMAC key: %v", err)
+		}
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: cfg.Tls.Acme.EabKeyID,
+			Key: key,
+		}
+	}
+	return m, nil
+}
+
+// globHostPolicy returns an autocert.HostPolicy matching hosts against
+// patterns the same way httpHandler does: autocert.HostWhitelist only
+// compares hostnames literally, so it rejects every SNI name a glob
+// pattern like "*.example.com" in Hostnames is meant to cover.
+func globHostPolicy(patterns []string) autocert.HostPolicy {
+	return func(_ context.Context, host string) error {
+		for _, pattern := range patterns {
+			if glob.Glob(pattern, host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("acme/autocert: host %q not configured in Hosts", host)
+	}
+}
+
+func readConfig() (*Config, error) {
 	f, err := os.Open(*confpath)
 	if err != nil {
-		log.Fatalf("%v :-(\n", err)
+		return nil, err
 	}
 	defer f.Close()
 	buf, err := ioutil.ReadAll(f)
 	if err != nil {
-		log.Fatalf("%v :-(\n", err)
+		return nil, err
 	}
-	if err := yaml.Unmarshal(buf, &config); err != nil {
-		log.Fatalf("%v :-(\n", err)
+	cfg := &Config{}
+	if err := yaml.Unmarshal(buf, cfg); err != nil {
+		return nil, err
 	}
-	for ib := range config.Hosts {
-		config.Hosts[ib].Initialize()
+	for ib := range cfg.Hosts {
+		cfg.Hosts[ib].Initialize()
 	}
+	return cfg, nil
 }
 
-func processConfig() {
-	if config.DefaultHost == "" {
-		config.DefaultHost = "localhost"
+// buildState turns a freshly parsed Config into a serverState, loading the
+// static keypair (or setting up the ACME manager), precomputing the
+// HSTS/Expect-CT headers and opening the SPKI pin store. It returns an
+// error instead of calling log.Fatalf so that a reload can reject a
+// broken config and keep the old one running. prev is the serverState
+// being replaced (nil on the initial load at startup); when PinLog and
+// PinEnforce haven't changed, its PinStore is carried forward instead of
+// rebuilt, so a reload unrelated to certs doesn't discard every pin
+// accumulated in memory since the process started.
+func buildState(cfg *Config, prev *serverState) (*serverState, error) {
+	st := &serverState{config: *cfg}
+	if cfg.DefaultHost == "" {
+		st.config.DefaultHost = "localhost"
 	}
-	if config.Tls.Cert != "" && config.Tls.Key != "" {
+	if cfg.Tls.Acme.Enabled {
 		var err error
-		tlsKeyPair, err = tls.LoadX509KeyPair(config.Tls.Cert, config.Tls.Key)
+		st.acmeManager, err = buildAcmeManager(cfg)
 		if err != nil {
-			log.Fatalf("Error reading TLS key/cert: %v :-(", err)
+			return nil, err
 		}
-		tlsKeyPair.Leaf, err = x509.ParseCertificate(tlsKeyPair.Certificate[len(tlsKeyPair.Certificate)-1])
+	} else if cfg.Tls.Cert != "" && cfg.Tls.Key != "" {
+		var err error
+		st.tlsKeyPair, err = tls.LoadX509KeyPair(cfg.Tls.Cert, cfg.Tls.Key)
 		if err != nil {
-			log.Fatalf("Error parsing TLS cert: %v :-(", err)
+			return nil, fmt.Errorf("error reading TLS key/cert: %v", err)
 		}
-		if config.Tls.Hsts.Seconds != 0 {
-			hstsHeader = fmt.Sprintf("max-age=%d", config.Tls.Hsts.Seconds)
-			if config.Tls.Hsts.Subdomains {
-				hstsHeader += "; includeSubdomains"
-			}
+		st.tlsKeyPair.Leaf, err = x509.ParseCertificate(st.tlsKeyPair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing TLS cert: %v", err)
 		}
-		if config.Tls.Hpkp.Seconds != 0 {
-			if len(config.Tls.Hpkp.BackupKeys) < 1 {
-				log.Printf("You should add a backup key to HPKP backup_keys!\n")
+	}
+	if cfg.Tls.Cert != "" && cfg.Tls.Key != "" || cfg.Tls.Acme.Enabled {
+		if cfg.Tls.Hsts.Seconds != 0 {
+			st.hstsHeader = fmt.Sprintf("max-age=%d", cfg.Tls.Hsts.Seconds)
+			if cfg.Tls.Hsts.Subdomains {
+				st.hstsHeader += "; includeSubdomains"
 			}
-			hash := sha256.Sum256(tlsKeyPair.Leaf.RawSubjectPublicKeyInfo)
-			hpkpHeader = fmt.Sprintf("pin-sha256=\"%s\"", base64.StdEncoding.EncodeToString(hash[0:]))
-			for k := range config.Tls.Hpkp.BackupKeys {
-				hpkpHeader += fmt.Sprintf("; pin-sha256=\"%s\"", config.Tls.Hpkp.BackupKeys[k])
+		}
+		if cfg.Tls.ExpectCt.Seconds != 0 {
+			st.expectCtHeader = fmt.Sprintf("max-age=%d", cfg.Tls.ExpectCt.Seconds)
+			if cfg.Tls.ExpectCt.Enforce {
+				st.expectCtHeader += ", enforce"
 			}
-			hpkpHeader += fmt.Sprintf("; max-age=%d", config.Tls.Hpkp.Seconds)
-			if config.Tls.Hpkp.Subdomains {
-				hpkpHeader += "; includeSubdomains"
+			if cfg.Tls.ExpectCt.ReportUri != "" {
+				st.expectCtHeader += fmt.Sprintf(", report-uri=\"%s\"", cfg.Tls.ExpectCt.ReportUri)
 			}
 		}
 	}
+	if prev != nil && prev.pinStore != nil && prev.pinStore.path == cfg.Tls.PinLog && prev.pinStore.enforce == cfg.Tls.PinEnforce {
+		st.pinStore = prev.pinStore
+	} else {
+		st.pinStore = NewPinStore(cfg.Tls.PinLog, cfg.Tls.PinEnforce)
+	}
+	return st, nil
 }
@@ -0,0 +1,175 @@
+// Package demux implements a cmux-style protocol router for a single TCP
+// listener: it peeks at the first bytes of every accepted connection and
+// hands it off to whichever protocol recognizes them, falling back to
+// returning the connection from Accept() unchanged for the default
+// protocol (TLS, in 443d's case).
+package demux
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// peekSize is how many bytes of each new connection are buffered before
+// any Matcher runs. It has to cover the longest magic prefix among the
+// matchers below (the PROXY protocol v2 signature, 12 bytes).
+const peekSize = 16
+
+// peekTimeout bounds how long Accept will wait for a connection to send
+// enough bytes to be matched (or unwrapped, for PROXY protocol) before
+// giving up on it. Without this, a client that opens a connection and
+// never sends anything would block Accept forever, since it runs in the
+// same goroutine that feeds the listener.
+const peekTimeout = 5 * time.Second
+
+// Matcher inspects the first bytes of a newly accepted connection and
+// reports whether this connection belongs to its protocol.
+type Matcher func(peek []byte) bool
+
+// Sink takes over a connection that a Matcher has claimed. Accept is
+// called in its own goroutine, so it may block for the lifetime of the
+// connection.
+type Sink interface {
+	Accept(conn net.Conn)
+}
+
+// Route pairs a Matcher with the Sink that should handle the connections
+// it recognizes.
+type Route struct {
+	Match Matcher
+	Sink  Sink
+}
+
+// DemultiplexingListener wraps a net.Listener and routes each accepted
+// connection to the first Route whose Matcher recognizes it. Connections
+// that match no Route are returned from Accept() as-is.
+//
+// Routes and ProxyProtocol are functions rather than plain fields so that
+// Accept can re-evaluate them on every connection: callers can have them
+// read from a reloadable config (an atomic.Value-backed serverState, for
+// instance) and have SIGHUP changes take effect immediately, without
+// recreating the listener.
+type DemultiplexingListener struct {
+	net.Listener
+	Routes func() []Route
+
+	// ProxyProtocol, when set, makes Accept first look for a PROXY
+	// protocol v1/v2 header, strip it and substitute the real client
+	// address it carries, before running the connection through Routes.
+	ProxyProtocol func() bool
+}
+
+func (l DemultiplexingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(peekTimeout))
+		buffered := bufio.NewReaderSize(conn, peekSize)
+		peek, err := buffered.Peek(peekSize)
+		if err != nil && err != io.EOF {
+			conn.Close()
+			continue
+		}
+		pconn := net.Conn(&peekedConn{Conn: conn, r: buffered})
+		if l.ProxyProtocol() {
+			pconn, peek, err = unwrapProxyProtocol(pconn, peek)
+			if err != nil {
+				log.Printf("Error reading PROXY protocol header: %v :-(\n", err)
+				conn.Close()
+				continue
+			}
+		}
+		conn.SetReadDeadline(time.Time{})
+		routed := false
+		for _, route := range l.Routes() {
+			if route.Match(peek) {
+				go route.Sink.Accept(pconn)
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			return pconn, nil
+		}
+	}
+}
+
+// peekedConn replays the bytes a Matcher peeked at before any Route or
+// the default protocol gets to read the connection for real.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SshMatcher recognizes the version-exchange line every SSH client and
+// server sends first, e.g. "SSH-2.0-OpenSSH_9.6".
+func SshMatcher(peek []byte) bool {
+	return bytes.HasPrefix(peek, []byte("SSH-"))
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+// HTTPMatcher recognizes a plain-text HTTP/1.x request line, for routing
+// plaintext upstreams that sit behind another TLS terminator.
+func HTTPMatcher(peek []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(peek, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenVPNMatcher recognizes an OpenVPN control-channel packet opened over
+// TCP: a 16-bit length prefix followed by an opcode/key-id byte whose top
+// 5 bits are a P_CONTROL_HARD_RESET_CLIENT* opcode (1, 7 or 10).
+func OpenVPNMatcher(peek []byte) bool {
+	if len(peek) < 3 {
+		return false
+	}
+	opcode := peek[2] >> 3
+	return opcode == 1 || opcode == 7 || opcode == 10
+}
+
+// WireGuardMatcher recognizes a WireGuard handshake initiation message
+// carried over TCP (type byte 1, followed by three zero reserved bytes).
+func WireGuardMatcher(peek []byte) bool {
+	return len(peek) >= 4 && peek[0] == 1 && peek[1] == 0 && peek[2] == 0 && peek[3] == 0
+}
+
+// Forwarder is a Sink that dials addr once per connection and pipes bytes
+// in both directions, for backends that speak their protocol directly
+// over the forwarded TCP connection (SSH, OpenVPN, WireGuard-over-TCP).
+type Forwarder string
+
+// NewForwarder returns a Sink that forwards every matched connection to addr.
+func NewForwarder(addr string) Forwarder {
+	return Forwarder(addr)
+}
+
+func (f Forwarder) Accept(conn net.Conn) {
+	defer conn.Close()
+	backend, err := net.Dial("tcp", string(f))
+	if err != nil {
+		log.Printf("Error dialing demux backend %s: %v :-(\n", string(f), err)
+		return
+	}
+	defer backend.Close()
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(backend, conn); done <- struct{}{} }()
+	go func() { io.Copy(conn, backend); done <- struct{}{} }()
+	<-done
+}
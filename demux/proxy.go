@@ -0,0 +1,93 @@
+package demux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// unwrapProxyProtocol checks peek for a PROXY protocol v1 or v2 header. If
+// found, it consumes the header from conn and returns a connection whose
+// RemoteAddr reports the real client address the header carries, along
+// with a fresh peek of the bytes that follow it. If no header is present,
+// conn and peek are returned unchanged.
+func unwrapProxyProtocol(conn net.Conn, peek []byte) (net.Conn, []byte, error) {
+	switch {
+	case bytes.HasPrefix(peek, proxyV1Prefix):
+		return unwrapProxyProtocolV1(conn)
+	case bytes.HasPrefix(peek, proxyV2Sig):
+		return unwrapProxyProtocolV2(conn)
+	default:
+		return conn, peek, nil
+	}
+}
+
+func unwrapProxyProtocolV1(conn net.Conn) (net.Conn, []byte, error) {
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	// "PROXY TCP4 <src> <dst> <srcport> <dstport>"
+	var addr net.Addr
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) >= 5 {
+		port, _ := strconv.Atoi(fields[4])
+		addr = &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: port}
+	}
+	return rewrap(conn, addr, r)
+}
+
+func unwrapProxyProtocolV2(conn net.Conn) (net.Conn, []byte, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint16(header[14:16])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, nil, err
+	}
+	var addr net.Addr
+	switch {
+	case header[13]>>4 == 0x1 && len(body) >= 12: // AF_INET
+		addr = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+	case header[13]>>4 == 0x2 && len(body) >= 36: // AF_INET6
+		addr = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+	}
+	return rewrap(conn, addr, bufio.NewReaderSize(conn, peekSize))
+}
+
+// rewrap wraps conn so RemoteAddr reports addr (when known) and a fresh
+// Matcher peek can be taken over r, which has already consumed the PROXY
+// protocol header but not whatever comes after it.
+func rewrap(conn net.Conn, addr net.Addr, r *bufio.Reader) (net.Conn, []byte, error) {
+	wrapped := &peekedConn{Conn: &addrOverrideConn{Conn: conn, remote: addr}, r: r}
+	peek, err := r.Peek(peekSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return wrapped, peek, nil
+}
+
+// addrOverrideConn reports a substitute RemoteAddr, for connections that
+// arrived wrapped in a PROXY protocol header carrying the real client
+// address.
+type addrOverrideConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrOverrideConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"golang.org/x/net/http2"
+)
+
+// HttpBackend describes one backend 443d proxies requests to, matched by
+// Hostnames glob patterns against the request Host header. Backend is a
+// plain "host:port" address; UpstreamScheme picks whether it's dialed as
+// plaintext HTTP or as HTTPS.
+type HttpBackend struct {
+	Hostnames []string
+	Backend   string
+
+	UpstreamScheme     string   `yaml:"upstream_scheme"`
+	UpstreamCaFile     string   `yaml:"upstream_ca_file"`
+	UpstreamServerName string   `yaml:"upstream_server_name"`
+	UpstreamClientCert string   `yaml:"upstream_client_cert"`
+	UpstreamClientKey  string   `yaml:"upstream_client_key"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	UpstreamPinSha256  []string `yaml:"upstream_pin_sha256"`
+
+	Handler http.Handler `yaml:"-"`
+}
+
+// Initialize builds the reverse proxy Handler for this backend from its
+// configured fields. It must be called once after the config is parsed,
+// before Handler is used.
+func (b *HttpBackend) Initialize() {
+	scheme := b.UpstreamScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	target, err := url.Parse(scheme + "://" + b.Backend)
+	if err != nil {
+		log.Fatalf("Error parsing backend address %q: %v :-(\n", b.Backend, err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if scheme == "https" {
+		transport, err := b.buildTransport()
+		if err != nil {
+			log.Fatalf("Error configuring upstream TLS for %q: %v :-(\n", b.Backend, err)
+		}
+		proxy.Transport = transport
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		// ReverseProxy.ServeHTTP already sets X-Forwarded-For from
+		// r.RemoteAddr (port stripped); setting it here too would just
+		// duplicate it with the port left in.
+		host := r.Host
+		director(r)
+		r.Header.Set("X-Forwarded-Host", host)
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	b.Handler = proxy
+}
+
+// buildTransport assembles a dedicated http.Transport for an HTTPS
+// backend: its own TLSClientConfig (optional CA, client cert, SNI
+// override, SPKI pinning) and its own HTTP/2-enabled connection pool, so
+// one misbehaving upstream can't exhaust another's connections.
+func (b *HttpBackend) buildTransport() (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         b.UpstreamServerName,
+		InsecureSkipVerify: b.InsecureSkipVerify,
+	}
+
+	if b.UpstreamCaFile != "" {
+		pem, err := ioutil.ReadFile(b.UpstreamCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading upstream_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream_ca_file %q", b.UpstreamCaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if b.UpstreamClientCert != "" && b.UpstreamClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(b.UpstreamClientCert, b.UpstreamClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading upstream client keypair: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(b.UpstreamPinSha256) > 0 {
+		pins := make(map[string]bool, len(b.UpstreamPinSha256))
+		for _, p := range b.UpstreamPinSha256 {
+			pins[p] = true
+		}
+		// VerifyPeerCertificate runs instead of, not in addition to, the
+		// normal verification once InsecureSkipVerify is set, so it has
+		// to redo the chain/expiry/hostname checks itself: the pin is a
+		// second factor on top of a valid certificate, not a replacement
+		// for having one. An empty DNSName makes Verify skip the hostname
+		// check entirely, so default it the same way the non-pinned path
+		// relies on http.Transport to do: to the dial host.
+		serverName := tlsConfig.ServerName
+		if serverName == "" {
+			if host, _, err := net.SplitHostPort(b.Backend); err == nil {
+				serverName = host
+			} else {
+				serverName = b.Backend
+			}
+		}
+		rootCAs := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			pinned := false
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("error parsing upstream certificate: %v", err)
+				}
+				certs = append(certs, cert)
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(hash[0:])] {
+					pinned = true
+				}
+			}
+			if !pinned {
+				return fmt.Errorf("no certificate in the chain matched an upstream_pin_sha256 pin")
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no certificates presented by upstream")
+			}
+			opts := x509.VerifyOptions{DNSName: serverName, Roots: rootCAs, Intermediates: x509.NewCertPool()}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := certs[0].Verify(opts); err != nil {
+				return fmt.Errorf("upstream certificate failed verification: %v", err)
+			}
+			return nil
+		}
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits configures the accept-path protections applied to every listener
+// (HTTP, TLS and Redirector): a global concurrent connection cap, a
+// per-remote-IP cap, and an optional token-bucket accept rate. Timeouts
+// here are in seconds, like the rest of the config.
+type Limits struct {
+	MaxConns      int     `yaml:"max_conns"`
+	MaxConnsPerIP int     `yaml:"max_conns_per_ip"`
+	AcceptRate    float64 `yaml:"accept_rate"`
+	AcceptBurst   int     `yaml:"accept_burst"`
+	ReadTimeout   int     `yaml:"read_timeout"`
+	WriteTimeout  int     `yaml:"write_timeout"`
+	IdleTimeout   int     `yaml:"idle_timeout"`
+	Metrics       string
+}
+
+// applyTimeouts sets srv's read/write/idle timeouts from the configured
+// values, leaving the http.Server defaults (no timeout) where a value is
+// zero or unset.
+func (l Limits) applyTimeouts(srv *http.Server) {
+	srv.ReadTimeout = time.Duration(l.ReadTimeout) * time.Second
+	srv.WriteTimeout = time.Duration(l.WriteTimeout) * time.Second
+	srv.IdleTimeout = time.Duration(l.IdleTimeout) * time.Second
+}
+
+// throttledListener wraps a net.Listener with a global concurrent
+// connection cap, a per-remote-IP concurrent connection cap and an
+// optional token-bucket accept rate, mirroring the throttled-listener
+// pattern Perkeep's webserver uses to defend against connection floods
+// without an external load balancer.
+//
+// limits is a function rather than a plain field so that Accept picks up
+// config changes (MaxConns, MaxConnsPerIP, AcceptRate/AcceptBurst) made
+// by a SIGHUP reload on the very next connection, instead of only at
+// listener creation.
+type throttledListener struct {
+	net.Listener
+	limits  func() Limits
+	limiter *rate.Limiter
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newThrottledListener(l net.Listener, limits func() Limits) *throttledListener {
+	tl := &throttledListener{Listener: l, limits: limits, perIP: make(map[string]int)}
+	if lim := limits(); lim.AcceptRate > 0 {
+		burst := lim.AcceptBurst
+		if burst < 1 {
+			burst = 1
+		}
+		tl.limiter = rate.NewLimiter(rate.Limit(lim.AcceptRate), burst)
+	}
+	return tl
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.updateLimiter()
+		if l.limiter != nil && !l.limiter.Allow() {
+			metrics.acceptRateRejected.Add(1)
+			conn.Close()
+			continue
+		}
+		ip := remoteIP(conn)
+		if !l.acquire(ip) {
+			metrics.connLimitRejected.Add(1)
+			conn.Close()
+			continue
+		}
+		return &throttledConn{Conn: conn, listener: l, ip: ip}, nil
+	}
+}
+
+// updateLimiter re-applies the current AcceptRate/AcceptBurst to the
+// token bucket, so a reload that changes them takes effect without
+// recreating the listener (and losing whatever burst was banked).
+func (l *throttledListener) updateLimiter() {
+	lim := l.limits()
+	if lim.AcceptRate <= 0 {
+		l.limiter = nil
+		return
+	}
+	burst := lim.AcceptBurst
+	if burst < 1 {
+		burst = 1
+	}
+	if l.limiter == nil {
+		l.limiter = rate.NewLimiter(rate.Limit(lim.AcceptRate), burst)
+		return
+	}
+	l.limiter.SetLimit(rate.Limit(lim.AcceptRate))
+	l.limiter.SetBurst(burst)
+}
+
+func (l *throttledListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim := l.limits()
+	if lim.MaxConns > 0 && l.total >= lim.MaxConns {
+		return false
+	}
+	if lim.MaxConnsPerIP > 0 && l.perIP[ip] >= lim.MaxConnsPerIP {
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *throttledListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// throttledConn releases its listener's per-IP/global slot on Close, so
+// limits reflect connections currently open rather than ever accepted.
+type throttledConn struct {
+	net.Conn
+	listener *throttledListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *throttledConn) Close() error {
+	c.once.Do(func() { c.listener.release(c.ip) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// counter is a monotonic counter safe for concurrent use, cheap enough to
+// bump on every rejected connection.
+type counter struct{ v uint64 }
+
+func (c *counter) Add(n uint64) { atomic.AddUint64(&c.v, n) }
+func (c *counter) Get() uint64  { return atomic.LoadUint64(&c.v) }
+
+var metrics struct {
+	connLimitRejected  counter
+	acceptRateRejected counter
+}
+
+// metricsHandler serves the accept-path counters in Prometheus exposition
+// format on the address configured at Limits.Metrics.
+var metricsHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "# TYPE _443d_rejected_connections_total counter\n")
+	fmt.Fprintf(w, "_443d_rejected_connections_total{reason=\"conn_limit\"} %d\n", metrics.connLimitRejected.Get())
+	fmt.Fprintf(w, "_443d_rejected_connections_total{reason=\"accept_rate\"} %d\n", metrics.acceptRateRejected.Get())
+})
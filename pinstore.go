@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// pinRecord is one line of the Tls.PinLog JSONL file: the first SPKI pin
+// observed for a hostname, trust-on-first-use style.
+type pinRecord struct {
+	Hostname  string `json:"hostname"`
+	Pin       string `json:"pin"`
+	FirstSeen int64  `json:"first_seen"`
+}
+
+// PinStore tracks the first-observed SPKI (SHA-256 of
+// RawSubjectPublicKeyInfo) pin for every hostname 443d serves a
+// certificate for, appending each new one to a JSONL audit log. It
+// replaces HPKP: instead of asking browsers to remember pins, 443d
+// remembers them itself and flags (or, with PinEnforce, refuses) an
+// unexpected change during the TLS handshake that first serves the
+// changed certificate, such as the first one after a reload.
+type PinStore struct {
+	path    string
+	enforce bool
+
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+// NewPinStore loads whatever pins the log at path already has on file; a
+// missing file is created on the first new pin. An empty path disables persistence; the
+// store still tracks pins in memory for the lifetime of the process.
+func NewPinStore(path string, enforce bool) *PinStore {
+	ps := &PinStore{path: path, enforce: enforce, pins: make(map[string]string)}
+	ps.load()
+	return ps
+}
+
+func (ps *PinStore) load() {
+	if ps.path == "" {
+		return
+	}
+	f, err := os.Open(ps.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec pinRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Ignoring malformed line in pin log %s: %v :-(\n", ps.path, err)
+			continue
+		}
+		ps.pins[rec.Hostname] = rec.Pin
+	}
+}
+
+// Observe computes the SPKI pin of cert and checks it against the pin on
+// file for hostname. The first certificate ever observed for a hostname
+// is trusted and recorded; after that, a changed pin is logged loudly
+// and, with PinEnforce set, rejected.
+func (ps *PinStore) Observe(hostname string, cert *x509.Certificate) error {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[0:])
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	known, seen := ps.pins[hostname]
+	if !seen {
+		ps.pins[hostname] = pin
+		ps.append(hostname, pin)
+		return nil
+	}
+	if known != pin {
+		log.Printf("SPKI pin for %s changed from %s to %s! :-(\n", hostname, known, pin)
+		if ps.enforce {
+			return fmt.Errorf("SPKI pin for %s changed unexpectedly", hostname)
+		}
+	}
+	return nil
+}
+
+func (ps *PinStore) append(hostname, pin string) {
+	if ps.path == "" {
+		return
+	}
+	f, err := os.OpenFile(ps.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening pin log %s: %v :-(\n", ps.path, err)
+		return
+	}
+	defer f.Close()
+	buf, err := json.Marshal(pinRecord{Hostname: hostname, Pin: pin, FirstSeen: time.Now().Unix()})
+	if err != nil {
+		log.Printf("Error encoding pin log entry: %v :-(\n", err)
+		return
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		log.Printf("Error writing pin log %s: %v :-(\n", ps.path, err)
+	}
+}